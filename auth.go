@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/pnet"
+)
+
+// LoadPSK reads a libp2p private-network PSK from path, in the same
+// "/key/swarm/psk/1.0.0/\n/base16/\n<hex>" format the swarm key generator
+// tools produce, and decodes it into the form libp2p.PrivateNetwork takes.
+func LoadPSK(path string) (pnet.PSK, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read psk %s: %w", path, err)
+	}
+	psk, err := pnet.DecodeV1PSK(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("decode psk %s: %w", path, err)
+	}
+	return psk, nil
+}
+
+// AllowList is the set of peer IDs authorized to open a Protocol stream to
+// this host. A nil *AllowList allows every peer, matching the coordinator's
+// historical behavior; once loaded from a file, only the peers it names are
+// let through.
+type AllowList struct {
+	peers map[peer.ID]bool
+}
+
+// LoadAllowList reads one base58 peer ID per line from path. Blank lines
+// and lines starting with "#" are ignored.
+func LoadAllowList(path string) (*AllowList, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open allow-list %s: %w", path, err)
+	}
+	defer f.Close()
+
+	al := &AllowList{peers: map[peer.ID]bool{}}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		id, err := peer.Decode(line)
+		if err != nil {
+			return nil, fmt.Errorf("allow-list %s: invalid peer ID %q: %w", path, line, err)
+		}
+		al.peers[id] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read allow-list %s: %w", path, err)
+	}
+	return al, nil
+}
+
+// Allowed reports whether id may open a stream to us. A nil AllowList
+// allows everyone.
+func (al *AllowList) Allowed(id peer.ID) bool {
+	if al == nil {
+		return true
+	}
+	return al.peers[id]
+}
+
+// SessionInvite is proof that a peer was invited to participate in a
+// specific session's roster. The organizer signs it with an Ed25519 key out
+// of band and distributes the resulting token to every invited peer; each
+// peer presents it when opening a stream so the receiving side can verify
+// it was actually invited to this computation, not merely that it knows the
+// rendezvous string.
+type SessionInvite struct {
+	SessionID string
+	Roster    []peer.ID
+	Signature []byte
+}
+
+// signingBytes is the canonical byte representation an organizer signs and
+// a verifier checks the signature against: the session ID followed by the
+// roster's peer IDs in sorted order, so the signature doesn't depend on
+// slice ordering.
+func (inv *SessionInvite) signingBytes() []byte {
+	roster := make([]string, len(inv.Roster))
+	for i, id := range inv.Roster {
+		roster[i] = id.Pretty()
+	}
+	sort.Strings(roster)
+	return []byte(inv.SessionID + "\n" + strings.Join(roster, "\n"))
+}
+
+// SignSessionInvite signs a new invite for sessionID and roster with the
+// organizer's Ed25519 private key.
+func SignSessionInvite(priv ed25519.PrivateKey, sessionID string, roster []peer.ID) *SessionInvite {
+	inv := &SessionInvite{SessionID: sessionID, Roster: roster}
+	inv.Signature = ed25519.Sign(priv, inv.signingBytes())
+	return inv
+}
+
+// Verify checks that inv was signed by pub for the given sessionID and that
+// presenter is named in inv.Roster. Without the roster check, the same
+// token would admit any peer, not just the ones the organizer invited.
+func (inv *SessionInvite) Verify(pub ed25519.PublicKey, sessionID string, presenter peer.ID) error {
+	if inv.SessionID != sessionID {
+		return fmt.Errorf("invite is for session %q, not %q", inv.SessionID, sessionID)
+	}
+	if !ed25519.Verify(pub, inv.signingBytes(), inv.Signature) {
+		return fmt.Errorf("invite signature does not verify")
+	}
+	member := false
+	for _, id := range inv.Roster {
+		if id == presenter {
+			member = true
+			break
+		}
+	}
+	if !member {
+		return fmt.Errorf("peer %s is not in the invited roster", presenter)
+	}
+	return nil
+}
+
+// LoadSessionInvite reads a SessionInvite, as returned by
+// SignSessionInvite and encoded with encoding/json, from path.
+func LoadSessionInvite(path string) (*SessionInvite, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read invite %s: %w", path, err)
+	}
+	var inv SessionInvite
+	if err := json.Unmarshal(data, &inv); err != nil {
+		return nil, fmt.Errorf("parse invite %s: %w", path, err)
+	}
+	return &inv, nil
+}
+
+// Admission bundles the checks a ProxyService runs before forwarding a
+// stream to its backend, and what it presents of its own when opening one.
+// A nil *Admission disables all checks, matching the coordinator's
+// historical fully-open behavior.
+type Admission struct {
+	AllowList *AllowList
+	// InvitePub verifies invite tokens presented by incoming streams. Nil
+	// disables invite verification.
+	InvitePub ed25519.PublicKey
+	// Invite is presented on outgoing streams we open. Nil means we present
+	// no invite, which only succeeds against peers that aren't requiring one.
+	Invite *SessionInvite
+	// SessionID is the session the invite must have been signed for.
+	SessionID string
+}
+
+// checkIncoming rejects a stream whose remote peer isn't allow-listed, or
+// whose presented invite doesn't verify, before it reaches the backend. On
+// success it returns the stream positioned at the start of the proxied
+// payload (the invite preamble, if any, has already been consumed).
+//
+// It always reads the one-byte has-invite flag presentOutgoing writes,
+// regardless of whether this side's Admission cares about invites at all:
+// the flag is part of the stream's wire framing, not conditioned on local
+// config, so an invite presented to a peer that doesn't require one is
+// consumed and ignored, and a missing invite where one is required is
+// rejected, instead of the invite's bytes being misread as the channel
+// header.
+func (a *Admission) checkIncoming(stream network.Stream) error {
+	remote := stream.Conn().RemotePeer()
+
+	hasInvite, err := readInvitePresence(stream)
+	if err != nil {
+		return fmt.Errorf("reading invite preamble from %s: %w", remote, err)
+	}
+	var inv *SessionInvite
+	if hasInvite {
+		inv, err = readSessionInvite(stream)
+		if err != nil {
+			return fmt.Errorf("reading invite from %s: %w", remote, err)
+		}
+	}
+
+	if a == nil {
+		return nil
+	}
+
+	if !a.AllowList.Allowed(remote) {
+		return fmt.Errorf("peer %s is not on the allow-list", remote)
+	}
+
+	if a.InvitePub != nil {
+		if inv == nil {
+			return fmt.Errorf("peer %s presented no invite", remote)
+		}
+		if err := inv.Verify(a.InvitePub, a.SessionID, remote); err != nil {
+			return fmt.Errorf("invite from %s: %w", remote, err)
+		}
+	}
+
+	return nil
+}
+
+// presentOutgoing writes the one-byte has-invite flag every stream carries
+// as a preamble, followed by our invite if we have one, so the receiving
+// side's checkIncoming always knows whether an invite follows before
+// trying to parse one.
+func (a *Admission) presentOutgoing(stream network.Stream) error {
+	var inv *SessionInvite
+	if a != nil {
+		inv = a.Invite
+	}
+	if err := writeInvitePresence(stream, inv != nil); err != nil {
+		return err
+	}
+	if inv == nil {
+		return nil
+	}
+	return writeSessionInvite(stream, inv)
+}
+
+// writeInvitePresence writes the flag that precedes every stream's optional
+// invite, so readInvitePresence can tell a peer presenting no invite from a
+// malformed one instead of the two being ambiguous on the wire.
+func writeInvitePresence(w io.Writer, present bool) error {
+	var b byte
+	if present {
+		b = 1
+	}
+	if _, err := w.Write([]byte{b}); err != nil {
+		return fmt.Errorf("write invite presence: %w", err)
+	}
+	return nil
+}
+
+// readInvitePresence reads the flag written by writeInvitePresence.
+func readInvitePresence(r io.Reader) (bool, error) {
+	var b [1]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return false, fmt.Errorf("read invite presence: %w", err)
+	}
+	return b[0] != 0, nil
+}
+
+// writeSessionInvite writes inv to w as a length-prefixed JSON frame, so the
+// reader on the other end can tell where the invite preamble ends and the
+// proxied payload begins.
+func writeSessionInvite(w io.Writer, inv *SessionInvite) error {
+	data, err := json.Marshal(inv)
+	if err != nil {
+		return fmt.Errorf("marshal invite: %w", err)
+	}
+	if err := binary.Write(w, binary.BigEndian, uint32(len(data))); err != nil {
+		return fmt.Errorf("write invite length: %w", err)
+	}
+	if _, err := w.Write(data); err != nil {
+		return fmt.Errorf("write invite: %w", err)
+	}
+	return nil
+}
+
+// buildAdmission assembles an *Admission from the coordinator's CLI flags.
+// It returns nil, matching the coordinator's historical fully-open
+// behavior, when none of allowListFile, inviteFile, or invitePubHex were
+// given.
+func buildAdmission(allowListFile, inviteFile, invitePubHex, sessionID string) (*Admission, error) {
+	if allowListFile == "" && inviteFile == "" && invitePubHex == "" {
+		return nil, nil
+	}
+
+	a := &Admission{SessionID: sessionID}
+
+	if allowListFile != "" {
+		al, err := LoadAllowList(allowListFile)
+		if err != nil {
+			return nil, err
+		}
+		a.AllowList = al
+	}
+
+	if invitePubHex != "" {
+		pub, err := hex.DecodeString(invitePubHex)
+		if err != nil {
+			return nil, fmt.Errorf("invite public key: %w", err)
+		}
+		if len(pub) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invite public key: expected %d bytes, got %d", ed25519.PublicKeySize, len(pub))
+		}
+		a.InvitePub = ed25519.PublicKey(pub)
+	}
+
+	if inviteFile != "" {
+		inv, err := LoadSessionInvite(inviteFile)
+		if err != nil {
+			return nil, err
+		}
+		a.Invite = inv
+	}
+
+	return a, nil
+}
+
+// readSessionInvite reads a length-prefixed JSON frame written by
+// writeSessionInvite.
+func readSessionInvite(r io.Reader) (*SessionInvite, error) {
+	var length uint32
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return nil, fmt.Errorf("read invite length: %w", err)
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, fmt.Errorf("read invite body: %w", err)
+	}
+	var inv SessionInvite
+	if err := json.Unmarshal(data, &inv); err != nil {
+		return nil, fmt.Errorf("parse invite: %w", err)
+	}
+	return &inv, nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// testPeerID generates a fresh peer ID for use as test fixture data. Tests
+// shouldn't hardcode a base58 string whose provenance isn't obvious.
+func testPeerID(t *testing.T) peer.ID {
+	t.Helper()
+	_, pub, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate peer key: %v", err)
+	}
+	id, err := peer.IDFromPublicKey(pub)
+	if err != nil {
+		t.Fatalf("derive peer ID: %v", err)
+	}
+	return id
+}
+
+func TestSessionInviteVerify(t *testing.T) {
+	orgPub, orgPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate organizer key: %v", err)
+	}
+	otherPub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate other key: %v", err)
+	}
+
+	alice := testPeerID(t)
+	bob := testPeerID(t)
+	mallory := testPeerID(t)
+
+	roster := []peer.ID{alice, bob}
+	invite := SignSessionInvite(orgPriv, "session-1", roster)
+
+	// The same signature, carried on a roster listed in a different order.
+	reorderedInvite := &SessionInvite{SessionID: "session-1", Roster: []peer.ID{bob, alice}, Signature: invite.Signature}
+
+	tests := []struct {
+		name      string
+		invite    *SessionInvite
+		pub       ed25519.PublicKey
+		sessionID string
+		presenter peer.ID
+		wantErr   bool
+	}{
+		{"valid invite", invite, orgPub, "session-1", alice, false},
+		{"bad signature", invite, otherPub, "session-1", alice, true},
+		{"wrong session ID", invite, orgPub, "session-2", alice, true},
+		{"presenter not in roster", invite, orgPub, "session-1", mallory, true},
+		{"roster reordering still verifies", reorderedInvite, orgPub, "session-1", alice, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.invite.Verify(tt.pub, tt.sessionID, tt.presenter)
+			if tt.wantErr && err == nil {
+				t.Fatalf("Verify() succeeded, want error")
+			}
+			if !tt.wantErr && err != nil {
+				t.Fatalf("Verify() = %v, want success", err)
+			}
+		})
+	}
+}
+
+func TestAllowListAllowed(t *testing.T) {
+	member := testPeerID(t)
+	stranger := testPeerID(t)
+
+	al := &AllowList{peers: map[peer.ID]bool{member: true}}
+
+	if !al.Allowed(member) {
+		t.Errorf("Allowed(%s) = false, want true", member)
+	}
+	if al.Allowed(stranger) {
+		t.Errorf("Allowed(%s) = true, want false", stranger)
+	}
+
+	var nilList *AllowList
+	if !nilList.Allowed(stranger) {
+		t.Errorf("nil AllowList.Allowed(%s) = false, want true (nil allows everyone)", stranger)
+	}
+}
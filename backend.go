@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// PartyBackend is implemented by anything capable of driving the local MPC
+// engine for this host's party. ProxyService forwards each libp2p stream it
+// accepts or opens to a backend, which is responsible for getting bytes to
+// and from the actual MPC process listening on the local TCP port.
+//
+// HandleIncoming is called when a remote party has opened a stream to us and
+// we need a local party to accept the forwarded connection on port.
+// HandleOutgoing is called when we are about to forward a local connection
+// to remotePeer and need a local party to originate it on port. channelID
+// identifies which of the (possibly several, concurrently open) logical
+// channels to that peer this connection carries, so a backend that
+// distinguishes traffic by purpose (OT extension, beaver triples, ...) can
+// route accordingly instead of treating every stream to a peer the same.
+//
+// Implementations must not block past the point where the local endpoint is
+// ready to accept/dial on port; long-running party processes should be
+// supervised in a goroutine and report failures through the returned error
+// or a later log line, not by exiting the whole coordinator.
+type PartyBackend interface {
+	HandleIncoming(ctx context.Context, port int, channelID uint32) error
+	HandleOutgoing(ctx context.Context, port int, remotePeer peer.ID, channelID uint32) error
+}
+
+// ExecBackend drives an external MPC party process via `make
+// incoming-connection` / `make outgoing-connection`, the same hooks the
+// coordinator has always used. Unlike the old free-standing runExternal
+// helper, failures are returned to the caller instead of calling
+// log.Fatal, so one party's misbehaving process no longer takes down a
+// multi-party session running on the same host.
+type ExecBackend struct {
+	// Dir is the working directory the `make` invocation runs in, e.g. the
+	// checkout of the MPC engine. Empty means the coordinator's own cwd.
+	Dir string
+}
+
+func (b *ExecBackend) HandleIncoming(ctx context.Context, port int, channelID uint32) error {
+	return b.runExternal(ctx, "incoming-connection", port, channelID)
+}
+
+func (b *ExecBackend) HandleOutgoing(ctx context.Context, port int, remotePeer peer.ID, channelID uint32) error {
+	return b.runExternal(ctx, "outgoing-connection", port, channelID)
+}
+
+func (b *ExecBackend) runExternal(ctx context.Context, event string, port int, channelID uint32) error {
+	cmd := exec.CommandContext(ctx, "make", event)
+	cmd.Dir = b.Dir
+	cmd.Env = append(os.Environ(), fmt.Sprintf("PORT=%d", port), fmt.Sprintf("CHANNEL=%d", channelID))
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("make %s: %w", event, err)
+	}
+	return nil
+}
+
+// NativeHandlerFunc drives a party in-process, e.g. an MPC engine linked in
+// as a Go package rather than shelled out to. It is handed the local port
+// the coordinator is proxying on and the logical channel the connection
+// belongs to, and is expected to listen (HandleIncoming) or dial
+// (HandleOutgoing) on it itself.
+type NativeHandlerFunc func(ctx context.Context, port int, channelID uint32) error
+
+// NativeBackend wires in-process handler functions as a PartyBackend,
+// avoiding the cost of an external process for MPC engines written in Go.
+type NativeBackend struct {
+	Incoming NativeHandlerFunc
+	Outgoing NativeHandlerFunc
+}
+
+func (b *NativeBackend) HandleIncoming(ctx context.Context, port int, channelID uint32) error {
+	if b.Incoming == nil {
+		return fmt.Errorf("native backend: no incoming handler registered")
+	}
+	return b.Incoming(ctx, port, channelID)
+}
+
+func (b *NativeBackend) HandleOutgoing(ctx context.Context, port int, remotePeer peer.ID, channelID uint32) error {
+	if b.Outgoing == nil {
+		return fmt.Errorf("native backend: no outgoing handler registered")
+	}
+	return b.Outgoing(ctx, port, channelID)
+}
+
+// UnixSocketBackend forwards party lifecycle events to an MPC engine
+// running as a separate process over a Unix domain socket, so engines
+// written in other languages can register as parties without the
+// coordinator knowing anything about their runtime. The engine listens on
+// SocketPath for newline-delimited "incoming <port> <channel>" / "outgoing
+// <port> <channel>" requests and is expected to reply "ok" or "error
+// <reason>".
+//
+// This is intentionally a small hand-rolled protocol rather than gRPC: it
+// keeps the coordinator free of a generated-stub dependency while still
+// giving non-Go engines a language-agnostic registration point. A
+// gRPC-based backend can be added alongside this one by implementing the
+// same PartyBackend interface once a concrete engine needs it.
+type UnixSocketBackend struct {
+	SocketPath string
+	Timeout    time.Duration
+}
+
+func (b *UnixSocketBackend) HandleIncoming(ctx context.Context, port int, channelID uint32) error {
+	return b.request(ctx, fmt.Sprintf("incoming %d %d", port, channelID))
+}
+
+func (b *UnixSocketBackend) HandleOutgoing(ctx context.Context, port int, remotePeer peer.ID, channelID uint32) error {
+	return b.request(ctx, fmt.Sprintf("outgoing %d %d", port, channelID))
+}
+
+func (b *UnixSocketBackend) request(ctx context.Context, line string) error {
+	dialer := net.Dialer{Timeout: b.timeout()}
+	conn, err := dialer.DialContext(ctx, "unix", b.SocketPath)
+	if err != nil {
+		return fmt.Errorf("dial party engine at %s: %w", b.SocketPath, err)
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if _, err := fmt.Fprintf(conn, "%s\n", line); err != nil {
+		return fmt.Errorf("send request to party engine: %w", err)
+	}
+
+	reply := make([]byte, 256)
+	n, err := conn.Read(reply)
+	if err != nil {
+		return fmt.Errorf("read reply from party engine: %w", err)
+	}
+	resp := string(reply[:n])
+	if len(resp) >= 2 && resp[:2] == "ok" {
+		return nil
+	}
+	return fmt.Errorf("party engine rejected %q: %s", line, resp)
+}
+
+func (b *UnixSocketBackend) timeout() time.Duration {
+	if b.Timeout == 0 {
+		return 10 * time.Second
+	}
+	return b.Timeout
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestChannelHeaderRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeChannelHeader(&buf, 42); err != nil {
+		t.Fatalf("writeChannelHeader() = %v", err)
+	}
+
+	got, err := readChannelHeader(&buf)
+	if err != nil {
+		t.Fatalf("readChannelHeader() = %v", err)
+	}
+	if got != 42 {
+		t.Errorf("readChannelHeader() = %d, want 42", got)
+	}
+}
+
+func TestChannelAllocatorNext(t *testing.T) {
+	c := newChannelAllocator()
+	alice := testPeerID(t)
+	bob := testPeerID(t)
+
+	if got := c.Next(alice); got != 0 {
+		t.Errorf("first Next(alice) = %d, want 0", got)
+	}
+	if got := c.Next(alice); got != 1 {
+		t.Errorf("second Next(alice) = %d, want 1", got)
+	}
+	if got := c.Next(bob); got != 0 {
+		t.Errorf("first Next(bob) = %d, want 0 (per-peer sequence)", got)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// LoadOrCreateIdentity loads an Ed25519 private key from path, generating
+// and persisting a new one if the file doesn't exist yet. This is what lets
+// a node's multiaddress stay valid across restarts, so a "server" node can
+// actually be used as a stable bootstrap peer instead of writing a useless
+// local/server.p2p every launch.
+func LoadOrCreateIdentity(path string) (crypto.PrivKey, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		priv, err := crypto.UnmarshalPrivateKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("parse identity %s: %w", path, err)
+		}
+		return priv, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("read identity %s: %w", path, err)
+	}
+
+	priv, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("generate identity: %w", err)
+	}
+
+	data, err = crypto.MarshalPrivateKey(priv)
+	if err != nil {
+		return nil, fmt.Errorf("marshal identity: %w", err)
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return nil, fmt.Errorf("write identity %s: %w", path, err)
+	}
+
+	return priv, nil
+}
+
+// parseBootstrapPeers splits a comma-separated list of multiaddresses, as
+// accepted by the -bootstrap flag, into AddrInfos.
+func parseBootstrapPeers(csv string) ([]peer.AddrInfo, error) {
+	if csv == "" {
+		return nil, nil
+	}
+
+	var peers []peer.AddrInfo
+	for _, addr := range strings.Split(csv, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+		peerInfo, err := parseAddressErr(addr)
+		if err != nil {
+			return nil, fmt.Errorf("bootstrap peer %q: %w", addr, err)
+		}
+		peers = append(peers, *peerInfo)
+	}
+	return peers, nil
+}
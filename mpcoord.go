@@ -10,17 +10,22 @@ import (
 	"math/rand"
 	"net"
 	"os"
-	"os/exec"
+	"sync"
 	"time"
 
 	// We need to import libp2p's libraries that we use in this project.
 	"github.com/libp2p/go-libp2p"
-	circuit "github.com/libp2p/go-libp2p-circuit"
+	"github.com/libp2p/go-libp2p-core/crypto"
 	"github.com/libp2p/go-libp2p-core/host"
 	"github.com/libp2p/go-libp2p-core/network"
 	"github.com/libp2p/go-libp2p-core/peer"
 	"github.com/libp2p/go-libp2p-core/peerstore"
+	"github.com/libp2p/go-libp2p-core/pnet"
 	kaddht "github.com/libp2p/go-libp2p-kad-dht"
+	noise "github.com/libp2p/go-libp2p-noise"
+	libp2pquic "github.com/libp2p/go-libp2p-quic-transport"
+	libp2ptls "github.com/libp2p/go-libp2p-tls"
+	relay "github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/relay"
 	ma "github.com/multiformats/go-multiaddr"
 )
 
@@ -31,22 +36,110 @@ import (
 const Protocol = "/mpcoord/0.0.1"
 const Rendezvous = "/mpcoord"
 
-// makeRandomHost creates a libp2p host with a randomly generated identity.
-// This step is described in depth in other tutorials.
-func makeRandomHost() (host.Host, *kaddht.IpfsDHT) {
+// HostConfig configures the libp2p host and DHT makeHost builds. The zero
+// value gives a random identity, a random TCP listen port (plus QUIC on
+// the same port number), and a client-mode DHT that relies on the ambient
+// IPFS bootstrap peers.
+type HostConfig struct {
+	// PSK joins the host to a libp2p private network when non-nil; swarm
+	// connections that don't complete the PSK handshake are dropped before
+	// they ever reach our stream handlers.
+	PSK pnet.PSK
+	// Identity is this host's persistent keypair. Nil generates a random
+	// one, which is fine for a throwaway client but useless for a node
+	// meant to be reused as a stable bootstrap peer.
+	Identity crypto.PrivKey
+	// ListenAddr is the multiaddress to listen on. Empty picks a random
+	// TCP port on all interfaces, plus QUIC on the same port number when
+	// PSK is nil.
+	ListenAddr string
+	// BootstrapMode runs the DHT in server mode, advertising this node as
+	// a routing table entry other peers can query, rather than only
+	// looking things up for ourselves.
+	BootstrapMode bool
+	// BootstrapPeers are connected to on startup in addition to (or, for
+	// an isolated deployment, instead of) the ambient IPFS bootstrap set.
+	BootstrapPeers []peer.AddrInfo
+	// RelayService runs this host as a circuit relay v2 relay, accepting
+	// reservations from other peers so they can be reached through us.
+	// Set on dedicated relay nodes, not on ordinary clients.
+	RelayService bool
+	// StaticRelays are relays this host should obtain a circuit v2
+	// reservation from via AutoRelay, so its relay address is populated
+	// into host.Addrs() automatically instead of being spliced together
+	// by hand from a relay address the host may not actually have a
+	// reservation with.
+	StaticRelays []peer.AddrInfo
+}
+
+// makeHost creates a libp2p host and DHT per cfg. This step is described in
+// depth in other tutorials.
+func makeHost(cfg HostConfig) (host.Host, *kaddht.IpfsDHT) {
 	ctx := context.Background()
-	port := 10000 + rand.Intn(10000)
 
-	host, err := libp2p.New(ctx,
-		libp2p.ListenAddrStrings(fmt.Sprintf("/ip4/0.0.0.0/tcp/%d", port)),
-		libp2p.EnableRelay(circuit.OptHop, circuit.OptDiscovery))
+	// go-libp2p's QUIC transport doesn't support pnet-style private
+	// networks, so a PSK-protected host has to stay on TCP; everyone else
+	// gets QUIC alongside it. MPC protocols exchange lots of small
+	// correlated messages (OT extensions, beaver triples), and QUIC's
+	// independent streams avoid the head-of-line blocking a single TCP
+	// connection would otherwise impose on them.
+	quicEnabled := cfg.PSK == nil
+
+	listenAddrs := []string{cfg.ListenAddr}
+	if cfg.ListenAddr == "" {
+		port := 10000 + rand.Intn(10000)
+		listenAddrs = []string{fmt.Sprintf("/ip4/0.0.0.0/tcp/%d", port)}
+		if quicEnabled {
+			listenAddrs = append(listenAddrs, fmt.Sprintf("/ip4/0.0.0.0/udp/%d/quic", port))
+		}
+	}
+
+	opts := []libp2p.Option{
+		libp2p.ListenAddrStrings(listenAddrs...),
+		libp2p.Security(noise.ID, noise.New),
+		libp2p.Security(libp2ptls.ID, libp2ptls.New),
+		libp2p.EnableRelay(),
+		// MPC parties are usually behind NATs; try to get a direct,
+		// unrelayed path between them once a relayed connection exists,
+		// since relays cap bandwidth in a way large secret-shared
+		// computations feel.
+		libp2p.EnableHolePunching(),
+		libp2p.EnableNATService(),
+		libp2p.NATPortMap(),
+	}
+	if quicEnabled {
+		opts = append(opts, libp2p.Transport(libp2pquic.NewTransport))
+	}
+	if cfg.PSK != nil {
+		opts = append(opts, libp2p.PrivateNetwork(cfg.PSK))
+	}
+	if cfg.Identity != nil {
+		opts = append(opts, libp2p.Identity(cfg.Identity))
+	}
+	if len(cfg.StaticRelays) > 0 {
+		opts = append(opts, libp2p.EnableAutoRelayWithStaticRelays(cfg.StaticRelays))
+	}
+
+	host, err := libp2p.New(ctx, opts...)
 	if err != nil {
 		log.Fatal(err)
 	}
+	host.Network().Notify(newDirectUpgradeNotifiee())
+
+	if cfg.RelayService {
+		if _, err := relay.New(host, relay.WithResources(relay.DefaultResources())); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	dhtOpts := []kaddht.Option{}
+	if cfg.BootstrapMode {
+		dhtOpts = append(dhtOpts, kaddht.Mode(kaddht.ModeServer))
+	}
 
 	// Bootstrap the DHT. In the default configuration, this spawns a Background
 	// thread that will refresh the peer table every five minutes.
-	dht, err := kaddht.New(ctx, host)
+	dht, err := kaddht.New(ctx, host, dhtOpts...)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -55,6 +148,12 @@ func makeRandomHost() (host.Host, *kaddht.IpfsDHT) {
 		log.Fatal(err)
 	}
 
+	for _, pi := range cfg.BootstrapPeers {
+		if err := host.Connect(ctx, pi); err != nil {
+			log.Println("Warning: failed to connect to bootstrap peer", pi.ID, ":", err)
+		}
+	}
+
 	return host, dht
 }
 
@@ -62,7 +161,11 @@ func makeRandomHost() (host.Host, *kaddht.IpfsDHT) {
 // HTTP server which tunnels the requests to a destination peer running
 // ProxyService too.
 type ProxyService struct {
+	ctx        context.Context
 	host       host.Host
+	backend    PartyBackend
+	admission  *Admission
+	channels   *channelAllocator
 	remotePeer peer.ID
 }
 
@@ -76,17 +179,31 @@ type ProxyService struct {
 // perform the proxied http requests it receives from a different peer.
 //
 // The addresses for the remotePeer peer should be part of the host's peerstore.
-func NewProxyService(h host.Host) *ProxyService {
+//
+// backend drives the local MPC party for every stream this service
+// accepts or opens; ctx bounds its lifetime so a host can tear down a
+// session's ports and child processes without leaking them into the
+// next one. ctx should outlive every stream the service will ever
+// handle, e.g. the lifetime of one multi-party compute session.
+//
+// admission gates which streams reach the backend at all; pass nil to
+// accept streams from any peer, matching the coordinator's historical
+// behavior.
+func NewProxyService(ctx context.Context, h host.Host, backend PartyBackend, admission *Admission) *ProxyService {
+	p := &ProxyService{
+		ctx:       ctx,
+		host:      h,
+		backend:   backend,
+		admission: admission,
+		channels:  newChannelAllocator(),
+	}
+
 	// We let our host know that it needs to handle streams tagged with the
 	// protocol id that we have defined, and then handle them to
 	// our own streamHandling function.
-	h.SetStreamHandler(Protocol, func(stream network.Stream) {
-		handleRemoteConnection(stream)
-	})
+	h.SetStreamHandler(Protocol, p.handleRemoteConnection)
 
-	return &ProxyService{
-		host: h,
-	}
+	return p
 }
 
 func startDiscovery(dht *kaddht.IpfsDHT) chan peer.AddrInfo {
@@ -117,15 +234,32 @@ func startDiscovery(dht *kaddht.IpfsDHT) chan peer.AddrInfo {
 	return peerChan
 }
 
-// handleRemoteConnection is our function to handle any libp2p-net streams that belong
+// handleRemoteConnection is our method to handle any libp2p-net streams that belong
 // to our protocol. The streams should contain an HTTP request which we need
 // to parse, make on behalf of the original node, and then write the response
 // on the stream, before closing it.
-func handleRemoteConnection(stream network.Stream) {
-	log.Println("server: forwarding remote connection to local server")
+func (p *ProxyService) handleRemoteConnection(stream network.Stream) {
+	if err := p.admission.checkIncoming(stream); err != nil {
+		log.Println("server: rejecting unauthorized stream:", err)
+		stream.Reset()
+		return
+	}
 
-	port := 20000 + rand.Intn(10000)
-	go runExternal("incoming-connection", port)
+	channelID, err := readChannelHeader(stream)
+	if err != nil {
+		log.Println("server: rejecting stream with no channel header:", err)
+		stream.Reset()
+		return
+	}
+
+	log.Println("server: forwarding remote connection on channel", channelID, "to local server")
+
+	port := allocatePort(20000, 10000)
+	go func() {
+		if err := p.backend.HandleIncoming(p.ctx, port, channelID); err != nil {
+			log.Println("Error: backend failed to handle incoming connection:", err)
+		}
+	}()
 
 	// Connect.
 	for i := 0; i < 60; i++ {
@@ -138,9 +272,13 @@ func handleRemoteConnection(stream network.Stream) {
 
 		// Forward between stream and conn.
 		go forward(stream, conn)
-		go forward(conn, stream)
+		go func() {
+			forward(conn, stream)
+			releasePort(port)
+		}()
 		return
 	}
+	releasePort(port)
 	log.Println("Error: could not reach local server.")
 }
 
@@ -161,32 +299,68 @@ func (p *ProxyService) Serve(remotePeer peer.ID, port int) {
 	}()
 }
 
+// handleLocalConnection opens a new stream to remotePeer for conn. Each
+// local connection gets its own stream and its own channel ID, so an MPC
+// engine that wants several logical channels to the same party (OT
+// extension, beaver triples, ...) can open several local connections to
+// Serve's listener and have each one arrive at handleRemoteConnection
+// tagged distinctly instead of folded onto a single stream.
 func (p *ProxyService) handleLocalConnection(conn net.Conn, remotePeer peer.ID) {
-	log.Println("client: forwarding local connection to remote peer ", remotePeer)
+	channelID := p.channels.Next(remotePeer)
+	log.Println("client: forwarding local connection to remote peer", remotePeer, "on channel", channelID)
+
 	// We need to send the request to the remote libp2p peer, so
 	// we open a stream to it
-	stream, err := p.host.NewStream(context.Background(), remotePeer, Protocol)
+	stream, err := p.host.NewStream(p.ctx, remotePeer, Protocol)
 	if err != nil {
 		log.Println(err)
 		return
 	}
+	if err := p.admission.presentOutgoing(stream); err != nil {
+		log.Println("client: failed to present invite to", remotePeer, ":", err)
+		stream.Reset()
+		return
+	}
+	if err := writeChannelHeader(stream, channelID); err != nil {
+		log.Println("client: failed to write channel header to", remotePeer, ":", err)
+		stream.Reset()
+		return
+	}
 
 	// Forward between stream and conn.
 	go forward(stream, conn)
 	go forward(conn, stream)
 }
 
-func runExternal(event string, port int) {
-	cmd := exec.Command("make", event)
-	cmd.Env = append(cmd.Env, fmt.Sprintf("PORT=%d", port))
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	err := cmd.Run()
-	if err != nil {
-		log.Fatal(err)
+// allocatePort hands out a port in [base, base+span) that is not currently
+// reserved by another in-flight incoming stream or Serve listener, so
+// concurrent sessions on the same host don't race each other onto the same
+// port. Ports are released once the caller is done with them via
+// releasePort; a leaked allocation only shrinks the pool, it never causes
+// a collision.
+var (
+	portsMu  sync.Mutex
+	usedPort = map[int]bool{}
+)
+
+func allocatePort(base, span int) int {
+	portsMu.Lock()
+	defer portsMu.Unlock()
+	for {
+		port := base + rand.Intn(span)
+		if !usedPort[port] {
+			usedPort[port] = true
+			return port
+		}
 	}
 }
 
+func releasePort(port int) {
+	portsMu.Lock()
+	delete(usedPort, port)
+	portsMu.Unlock()
+}
+
 func forward(dst io.WriteCloser, src io.ReadCloser) {
 	_, err := io.Copy(dst, src)
 	if err != nil {
@@ -196,28 +370,19 @@ func forward(dst io.WriteCloser, src io.ReadCloser) {
 }
 
 func parseAddress(addr string) *peer.AddrInfo {
-	parsed, err := ma.NewMultiaddr(addr)
-	if err != nil {
-		log.Fatalln(err)
-	}
-	peerInfo, err := peer.AddrInfoFromP2pAddr(parsed)
+	peerInfo, err := parseAddressErr(addr)
 	if err != nil {
 		log.Fatal(err)
 	}
 	return peerInfo
 }
 
-func addRelayAddress(relayAddr string, peerInfo *peer.AddrInfo) {
-	if relayAddr == "" {
-		return
-	}
-	addr := fmt.Sprintf("%s/p2p-circuit/p2p/%s", relayAddr, peer.IDB58Encode(peerInfo.ID))
-	maddr, err := ma.NewMultiaddr(addr)
+func parseAddressErr(addr string) (*peer.AddrInfo, error) {
+	parsed, err := ma.NewMultiaddr(addr)
 	if err != nil {
-		log.Println("Warning:", err)
-		return
+		return nil, err
 	}
-	peerInfo.Addrs = append(peerInfo.Addrs, maddr)
+	return peer.AddrInfoFromP2pAddr(parsed)
 }
 
 // addAddrToPeerstore parses a peer multiaddress and adds
@@ -231,15 +396,6 @@ func addAddrToPeerstore(h host.Host, addr string) *peer.AddrInfo {
 	return peerInfo
 }
 
-func connectToPeer(h host.Host, addr string) (*peer.AddrInfo, error) {
-	peerInfo := parseAddress(addr)
-	err := h.Connect(context.Background(), *peerInfo)
-	if err != nil {
-		return nil, err
-	}
-	return peerInfo, nil
-}
-
 const help = `
 This example creates a simple TCP Proxy using two libp2p peers. The first peer
 provides an TCP server locally which tunnels the TCP requests with libp2p
@@ -260,13 +416,25 @@ func main() {
 
 	// Parse some flags
 	remotePeer := flag.String("c", "", "remote peer address")
-	pureRelay := flag.Bool("R", false, "run as a relay only")
-	relayPeer := flag.String("r", "", "connect to this relay")
+	pureRelay := flag.Bool("R", false, "run as a circuit v2 relay only")
+	relayPeer := flag.String("r", "", "obtain a circuit v2 reservation from this relay via AutoRelay")
+	sessionID := flag.String("session", "", "join this n-party session ID instead of the global rendezvous")
+	sessionN := flag.Int("n", 2, "number of parties expected in -session (including this one)")
+	pskFile := flag.String("psk", "", "path to a libp2p private-network PSK; only peers with the same PSK can connect")
+	allowListFile := flag.String("allowlist", "", "path to a file of authorized peer IDs, one per line")
+	inviteFile := flag.String("invite", "", "path to a signed SessionInvite token to present when opening streams")
+	invitePubHex := flag.String("invite-pubkey", "", "hex-encoded Ed25519 public key used to verify incoming SessionInvite tokens")
+	identityFile := flag.String("identity", "", "path to a persistent Ed25519 identity key; created if it doesn't exist")
+	listenAddr := flag.String("listen", "", "multiaddress to listen on (default: random TCP port on all interfaces)")
+	bootstrapMode := flag.Bool("B", false, "run as a dedicated DHT bootstrap node: routing only, no proxy/backend")
+	bootstrapPeersFlag := flag.String("bootstrap", "", "comma-separated multiaddresses of bootstrap peers to connect to on startup")
 	flag.Parse()
 
 	name := ""
 
-	if *pureRelay {
+	if *bootstrapMode {
+		name = "bootstrap"
+	} else if *pureRelay {
 		name = "relay"
 	} else if *remotePeer != "" {
 		name = "client"
@@ -277,7 +445,43 @@ func main() {
 	log.SetFlags(log.Lshortfile)
 	log.SetPrefix(name + ": ")
 
-	host, dht := makeRandomHost()
+	var psk pnet.PSK
+	if *pskFile != "" {
+		var err error
+		psk, err = LoadPSK(*pskFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var identity crypto.PrivKey
+	if *identityFile != "" {
+		var err error
+		identity, err = LoadOrCreateIdentity(*identityFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	bootstrapPeers, err := parseBootstrapPeers(*bootstrapPeersFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var staticRelays []peer.AddrInfo
+	if *relayPeer != "" {
+		staticRelays = []peer.AddrInfo{*parseAddress(*relayPeer)}
+	}
+
+	host, dht := makeHost(HostConfig{
+		PSK:            psk,
+		Identity:       identity,
+		ListenAddr:     *listenAddr,
+		BootstrapMode:  *bootstrapMode,
+		BootstrapPeers: bootstrapPeers,
+		RelayService:   *pureRelay,
+		StaticRelays:   staticRelays,
+	})
 	addr := ""
 
 	log.Println("Node", host.ID())
@@ -287,14 +491,6 @@ func main() {
 		fmt.Println(addr)
 	}
 
-	if *relayPeer != "" {
-		log.Println("Connecting to relay", *relayPeer)
-		connectToPeer(host, *relayPeer)
-
-		addr = fmt.Sprintf("%s/p2p-circuit/p2p/%s", *relayPeer, peer.IDB58Encode(host.ID()))
-		fmt.Println(addr)
-	}
-
 	// Save our address to a file.
 	filename := "local/" + name + ".p2p"
 	fd, err := os.Create(filename)
@@ -308,13 +504,23 @@ func main() {
 	fd.Close()
 	log.Println("Wrote my address in", filename)
 
-	if *pureRelay {
+	if *bootstrapMode {
+		log.Println("Running as dedicated bootstrap node: routing only, no proxy/backend.")
+		<-make(chan struct{}) // hang forever serving the DHT
+	} else if *pureRelay {
 		log.Println("Running as relay.")
 		<-make(chan struct{}) // hang forever as relay
 	} else {
+		ctx := context.Background()
+		backend := &ExecBackend{}
+
+		admission, err := buildAdmission(*allowListFile, *inviteFile, *invitePubHex, *sessionID)
+		if err != nil {
+			log.Fatal(err)
+		}
 
 		// Start the service.
-		proxy := NewProxyService(host)
+		proxy := NewProxyService(ctx, host, backend, admission)
 		peerChan := make(chan peer.AddrInfo, 1)
 
 		if name == "client" {
@@ -322,6 +528,23 @@ func main() {
 			remotePeerInfo := parseAddress(*remotePeer)
 			peerChan <- *remotePeerInfo
 			close(peerChan)
+		} else if *sessionID != "" {
+			// Session mode: block until all N parties of the named
+			// session have been found, then feed the whole roster
+			// (minus ourselves) through the usual connect-and-proxy loop.
+			session := &Session{ID: *sessionID, N: *sessionN}
+			roster, err := session.Join(ctx, host, dht)
+			if err != nil {
+				log.Fatal(err)
+			}
+			go func() {
+				for _, peerInfo := range roster {
+					if peerInfo.ID != host.ID() {
+						peerChan <- peerInfo
+					}
+				}
+				close(peerChan)
+			}()
 		} else {
 			// Auto mode: discover peers.
 			peerChan = startDiscovery(dht)
@@ -329,7 +552,6 @@ func main() {
 
 		for peerInfo := range peerChan {
 			log.Println("Found peer", peerInfo)
-			addRelayAddress(*relayPeer, &peerInfo)
 
 			// Make sure our host knows how to reach remotePeer.
 			err := host.Connect(context.Background(), peerInfo)
@@ -338,11 +560,25 @@ func main() {
 				continue
 			}
 
-			port := 30000 + rand.Intn(10000)
-			// Listen for local backend connections.
+			port := allocatePort(30000, 10000)
+			// Listen for local backend connections. proxy.Serve's listener
+			// stays bound to port for the rest of the session, so port
+			// stays allocated too; releasing it here would let a later
+			// roster member's allocatePort hand it back out from under
+			// the still-running listener.
 			proxy.Serve(peerInfo.ID, port)
-			// The backend client will connect to the proxy.Serve above.
-			runExternal("outgoing-connection", port)
+			// The backend party will connect to the proxy.Serve above.
+			// This kickoff call has no stream yet to carry a channel ID of
+			// its own, so it's tagged as the primary channel; the actual
+			// per-stream channel IDs are assigned once the backend dials
+			// in and handleLocalConnection opens the corresponding stream.
+			const primaryChannel = 0
+			peerInfo := peerInfo
+			go func() {
+				if err := backend.HandleOutgoing(ctx, port, peerInfo.ID, primaryChannel); err != nil {
+					log.Println("Error: backend failed to handle outgoing connection:", err)
+				}
+			}()
 		}
 	}
 
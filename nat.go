@@ -0,0 +1,47 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// directUpgradeNotifiee watches for a successful DCUtR hole punch. There is
+// no single "hole punch succeeded" event exposed by the host; what's
+// observable from the outside is that a peer we first reached over a
+// relay later gains a second, non-circuit connection to the same peer.
+// That is exactly what EnableHolePunching produces when it works, so we
+// log it as our upgrade signal and let everything else (stream dialing,
+// NewStream's own peerstore-driven address selection) keep working
+// unmodified if hole punching never succeeds and we stay on the relay.
+type directUpgradeNotifiee struct {
+	network.NoopNotifiee
+
+	mu      sync.Mutex
+	relayed map[peer.ID]bool
+}
+
+func newDirectUpgradeNotifiee() *directUpgradeNotifiee {
+	return &directUpgradeNotifiee{relayed: map[peer.ID]bool{}}
+}
+
+func (n *directUpgradeNotifiee) Connected(_ network.Network, conn network.Conn) {
+	remote := conn.RemotePeer()
+	relayed := strings.Contains(conn.RemoteMultiaddr().String(), "/p2p-circuit")
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if relayed {
+		n.relayed[remote] = true
+		return
+	}
+
+	if n.relayed[remote] {
+		log.Println("nat: direct connection to", remote, "established, hole-punch upgrade succeeded")
+		delete(n.relayed, remote)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/peer"
+	discovery "github.com/libp2p/go-libp2p-discovery"
+	kaddht "github.com/libp2p/go-libp2p-kad-dht"
+)
+
+// sessionRendezvousTTL bounds how long one of our discovery advertisements
+// is valid for before it needs renewing. Re-advertising well before it
+// expires keeps us visible to parties that start their own join a little
+// after ours.
+const sessionRendezvousTTL = 2 * time.Minute
+
+// findPeersInterval is how often we re-poll the DHT for new parties while
+// a Session.Join is still short of its roster.
+const findPeersInterval = 10 * time.Second
+
+// Session identifies one multi-party computation: a unique ID shared out of
+// band by whoever is organizing the computation, and the number of parties
+// N that are expected to join it. Where the old code advertised under the
+// single, global Rendezvous string and happily forwarded streams from
+// whichever two peers found each other first, a Session scopes discovery to
+// this one computation and waits for the full expected roster before
+// considering the join complete.
+type Session struct {
+	ID string
+	N  int
+}
+
+// rendezvous returns the session-scoped rendezvous string this session
+// advertises and searches under, derived from the shared Rendezvous
+// namespace so session traffic never collides with other mpcoord usages of
+// the same DHT.
+func (s *Session) rendezvous() string {
+	return fmt.Sprintf("%s/session/%s", Rendezvous, s.ID)
+}
+
+// Join advertises our participation in the session and polls the DHT for
+// the remaining N-1 parties until all of them have been found and
+// connected, or ctx is cancelled. The returned roster is every party's
+// AddrInfo, including our own, sorted by peer ID so every party in the
+// session can derive the same protocol party index by taking the roster's
+// position of its own ID.
+func (s *Session) Join(ctx context.Context, h host.Host, dht *kaddht.IpfsDHT) ([]peer.AddrInfo, error) {
+	if s.N < 1 {
+		return nil, fmt.Errorf("session %s: expected party count must be >= 1, got %d", s.ID, s.N)
+	}
+
+	routingDiscovery := discovery.NewRoutingDiscovery(dht)
+	rendezvous := s.rendezvous()
+
+	s.advertiseLoop(ctx, routingDiscovery, rendezvous)
+
+	joined := map[peer.ID]peer.AddrInfo{
+		h.ID(): {ID: h.ID(), Addrs: h.Addrs()},
+	}
+
+	for len(joined) < s.N {
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("session %s: join cancelled with %d/%d parties: %w", s.ID, len(joined), s.N, ctx.Err())
+		default:
+		}
+
+		peerChan, err := routingDiscovery.FindPeers(ctx, rendezvous)
+		if err != nil {
+			return nil, fmt.Errorf("session %s: find peers: %w", s.ID, err)
+		}
+
+		for peerInfo := range peerChan {
+			if peerInfo.ID == h.ID() {
+				continue
+			}
+			if existing, ok := joined[peerInfo.ID]; ok {
+				joined[peerInfo.ID] = mergeAddrInfo(existing, peerInfo)
+				continue
+			}
+			if err := h.Connect(ctx, peerInfo); err != nil {
+				log.Println("session", s.ID, ": failed to connect to", peerInfo.ID, ":", err)
+				continue
+			}
+			joined[peerInfo.ID] = peerInfo
+		}
+
+		if len(joined) >= s.N {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("session %s: join cancelled with %d/%d parties: %w", s.ID, len(joined), s.N, ctx.Err())
+		case <-time.After(findPeersInterval):
+		}
+	}
+
+	roster := make([]peer.AddrInfo, 0, len(joined))
+	for _, info := range joined {
+		roster = append(roster, info)
+	}
+	sort.Slice(roster, func(i, j int) bool {
+		return roster[i].ID < roster[j].ID
+	})
+
+	return roster, nil
+}
+
+// advertiseLoop advertises rendezvous immediately and keeps re-advertising
+// at sessionRendezvousTTL/2 until ctx is cancelled, so a slow-to-assemble
+// session doesn't fall out of the DHT while it's still waiting on parties.
+func (s *Session) advertiseLoop(ctx context.Context, routingDiscovery *discovery.RoutingDiscovery, rendezvous string) {
+	discovery.Advertise(ctx, routingDiscovery, rendezvous, discovery.TTL(sessionRendezvousTTL))
+
+	go func() {
+		ticker := time.NewTicker(sessionRendezvousTTL / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				discovery.Advertise(ctx, routingDiscovery, rendezvous, discovery.TTL(sessionRendezvousTTL))
+			}
+		}
+	}()
+}
+
+// mergeAddrInfo combines addresses discovered for the same peer across
+// multiple FindPeers rounds, deduplicating so a roster entry doesn't
+// accumulate repeated copies of the same multiaddr.
+func mergeAddrInfo(a, b peer.AddrInfo) peer.AddrInfo {
+	seen := make(map[string]bool, len(a.Addrs))
+	merged := a
+	for _, addr := range a.Addrs {
+		seen[addr.String()] = true
+	}
+	for _, addr := range b.Addrs {
+		if !seen[addr.String()] {
+			merged.Addrs = append(merged.Addrs, addr)
+			seen[addr.String()] = true
+		}
+	}
+	return merged
+}
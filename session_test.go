@@ -0,0 +1,28 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+func TestMergeAddrInfo(t *testing.T) {
+	id := testPeerID(t)
+	addr1, err := ma.NewMultiaddr("/ip4/127.0.0.1/tcp/4001")
+	if err != nil {
+		t.Fatalf("parse addr1: %v", err)
+	}
+	addr2, err := ma.NewMultiaddr("/ip4/10.0.0.1/tcp/4001")
+	if err != nil {
+		t.Fatalf("parse addr2: %v", err)
+	}
+
+	a := peer.AddrInfo{ID: id, Addrs: []ma.Multiaddr{addr1}}
+	b := peer.AddrInfo{ID: id, Addrs: []ma.Multiaddr{addr1, addr2}}
+
+	merged := mergeAddrInfo(a, b)
+	if len(merged.Addrs) != 2 {
+		t.Fatalf("mergeAddrInfo() has %d addrs, want 2 (deduplicated): %v", len(merged.Addrs), merged.Addrs)
+	}
+}